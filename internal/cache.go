@@ -0,0 +1,340 @@
+package cranelift
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazerolift/internal/wazero/engineext"
+	"github.com/tetratelabs/wazerolift/internal/wazero/platform"
+)
+
+// compilationCacheVersion must be bumped whenever the on-disk blob layout or the
+// cranelift_backend.wasm ABI changes, so that a cache written by an older build is
+// rejected at load time instead of being mis-executed.
+//
+// v2: blobs hold a fully mmap-ready *compiledModule (machine code with relocations
+// already applied, executableOffsets, opaqueVmContextOffsets) rather than the
+// per-function, pre-relocation bodies v1 stored; see SerializeCompiledModule.
+//
+// v3: the header also embeds moduleContentHash(module), checked against the module
+// being compiled before a blob is trusted; see sourceHash.
+const compilationCacheVersion = 3
+
+type compilationCacheDirKey struct{}
+
+// WithCompilationCacheDir returns a context derived from ctx that, once passed to
+// wazero.NewRuntimeWithConfig after ConfigureCranelift, opts the resulting engine into
+// an on-disk cache of Cranelift-produced machine code under dir. One file is written
+// per compiled module, so a process restart can skip invoking Cranelift entirely for
+// modules it has already compiled.
+func WithCompilationCacheDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, compilationCacheDirKey{}, dir)
+}
+
+func cacheDirFromContext(ctx context.Context) (string, bool) {
+	dir, ok := ctx.Value(compilationCacheDirKey{}).(string)
+	return dir, ok && dir != ""
+}
+
+// cacheKeyTag identifies the combination of cache layout, Cranelift ABI and
+// CPU/OS that a cached blob was produced under. It is embedded in every blob's
+// header so that a mismatched cache is rejected rather than mis-executed.
+func cacheKeyTag() string {
+	return fmt.Sprintf("wazerolift-cache-v%d-abi%d-%s-%s", compilationCacheVersion, craneliftABIVersion, runtime.GOARCH, runtime.GOOS)
+}
+
+// moduleContentHash hashes the wasm content CompileModule actually compiles from:
+// every function body and its local types, plus the counts and descriptors that
+// shape compilation (import/memory counts, memory limits, function types). This
+// engine never sees module's raw wasm bytes -- engineext.Module only exposes it
+// decoded -- so this is the closest available stand-in for "a hash of the source
+// wasm"; in practice it changes whenever the source wasm does. See sourceHash.
+func moduleContentHash(module engineext.Module) [32]byte {
+	h := sha256.New()
+	var buf [8]byte
+
+	writeU32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:4], v)
+		h.Write(buf[:4])
+	}
+	writeValueTypes := func(vts []api.ValueType) {
+		writeU32(uint32(len(vts)))
+		for _, vt := range vts {
+			h.Write([]byte{byte(vt)})
+		}
+	}
+
+	writeU32(module.ImportFuncCount())
+	writeU32(module.LocalMemoriesCount())
+	writeU32(module.ImportedMemoriesCount())
+	writeU32(module.HostFunctionCount())
+
+	n := module.TypeCounts()
+	writeU32(n)
+	for i := uint32(0); i < n; i++ {
+		params, results := module.Type(i)
+		writeValueTypes(params)
+		writeValueTypes(results)
+	}
+
+	codeCount := module.CodeCount()
+	writeU32(codeCount)
+	for i := uint32(0); i < codeCount; i++ {
+		localTypes, body := module.CodeAt(i)
+		writeValueTypes(localTypes)
+		writeU32(uint32(len(body)))
+		h.Write(body)
+	}
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// cacheFileName derives a filesystem-safe, content-addressed file name for id.
+// engineext.ModuleID's underlying representation isn't assumed here; hashing its
+// formatted form keeps this independent of that.
+func cacheFileName(id engineext.ModuleID) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v", id)))
+	return hex.EncodeToString(sum[:]) + ".crcache"
+}
+
+// SerializeCompiledModule writes a self-describing blob for the already-compiled
+// module id to w: a header identifying the cache layout/ABI/CPU/OS and the source
+// wasm it was compiled from (see moduleContentHash), the per-function
+// executableOffsets, the opaqueVmContextOffsets layout, and the raw machine code
+// (with direct-call relocations already applied). LoadCompiledModule reverses this.
+func (e *engine) SerializeCompiledModule(id engineext.ModuleID, w io.Writer) error {
+	compiled, ok := e.modules[id]
+	if !ok {
+		return fmt.Errorf("cranelift: module %v is not compiled", id)
+	}
+
+	tag := cacheKeyTag()
+	buf := make([]byte, 0, 96+len(tag)+len(compiled.executable))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(tag)))
+	buf = append(buf, tag...)
+	buf = append(buf, compiled.sourceHash[:]...)
+
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(compiled.executableOffsets)))
+	for _, off := range compiled.executableOffsets {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(off))
+	}
+
+	vmOffsets := compiled.opaqueVmContextOffsets
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(vmOffsets.totalSize))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vmOffsets.localMemoryBegins)))
+	for _, v := range vmOffsets.localMemoryBegins {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vmOffsets.importedMemoryBegins)))
+	for _, v := range vmOffsets.importedMemoryBegins {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(vmOffsets.importedFunctionsBegin))
+
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(compiled.executable)))
+	buf = append(buf, compiled.executable...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// LoadCompiledModule reverses SerializeCompiledModule: it validates the blob's
+// header against the current cache tag (layout version, ABI version, CPU/OS) and
+// against expectedSourceHash (the hash of the wasm the caller actually wants to
+// load; see moduleContentHash), then maps the embedded machine code directly via
+// platform.MmapCodeSegment rather than invoking Cranelift, and rebuilds a
+// *compiledModule around it. It returns an error for a corrupt, version-mismatched,
+// or source-mismatched blob; callers should treat that as a cache miss, since a
+// module ID can be reused across runs for a different wasm module.
+func (e *engine) LoadCompiledModule(_ context.Context, r io.Reader, expectedSourceHash [32]byte) (*compiledModule, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("cranelift: truncated cache entry")
+	}
+	tagLen := int(binary.LittleEndian.Uint32(raw))
+	raw = raw[4:]
+	if len(raw) < tagLen {
+		return nil, fmt.Errorf("cranelift: truncated cache entry")
+	}
+	if string(raw[:tagLen]) != cacheKeyTag() {
+		return nil, errCacheVersionMismatch
+	}
+	raw = raw[tagLen:]
+
+	if len(raw) < len(expectedSourceHash) {
+		return nil, fmt.Errorf("cranelift: truncated cache entry")
+	}
+	var sourceHash [32]byte
+	copy(sourceHash[:], raw[:len(sourceHash)])
+	raw = raw[len(sourceHash):]
+	if sourceHash != expectedSourceHash {
+		return nil, errCacheVersionMismatch
+	}
+
+	readU32 := func() (uint32, error) {
+		if len(raw) < 4 {
+			return 0, fmt.Errorf("cranelift: truncated cache entry")
+		}
+		v := binary.LittleEndian.Uint32(raw)
+		raw = raw[4:]
+		return v, nil
+	}
+	readU64 := func() (uint64, error) {
+		if len(raw) < 8 {
+			return 0, fmt.Errorf("cranelift: truncated cache entry")
+		}
+		v := binary.LittleEndian.Uint64(raw)
+		raw = raw[8:]
+		return v, nil
+	}
+	// readU32Count reads a uint32 entry count and rejects it if the remaining bytes
+	// can't possibly hold that many 8-byte entries, so a corrupt or malicious blob
+	// can't drive make([]int, count) into an oversized allocation.
+	readU32Count := func() (uint32, error) {
+		count, err := readU32()
+		if err != nil {
+			return 0, err
+		}
+		if uint64(count) > uint64(len(raw))/8 {
+			return 0, fmt.Errorf("cranelift: truncated cache entry: implausible entry count %d", count)
+		}
+		return count, nil
+	}
+
+	offsetCount, err := readU32Count()
+	if err != nil {
+		return nil, err
+	}
+	executableOffsets := make([]int, offsetCount)
+	for i := range executableOffsets {
+		v, err := readU64()
+		if err != nil {
+			return nil, err
+		}
+		executableOffsets[i] = int(v)
+	}
+
+	var vmOffsets opaqueVmContextOffsets
+	totalSize, err := readU64()
+	if err != nil {
+		return nil, err
+	}
+	vmOffsets.totalSize = int(totalSize)
+
+	localCount, err := readU32Count()
+	if err != nil {
+		return nil, err
+	}
+	vmOffsets.localMemoryBegins = make([]int, localCount)
+	for i := range vmOffsets.localMemoryBegins {
+		v, err := readU64()
+		if err != nil {
+			return nil, err
+		}
+		vmOffsets.localMemoryBegins[i] = int(v)
+	}
+
+	importedCount, err := readU32Count()
+	if err != nil {
+		return nil, err
+	}
+	vmOffsets.importedMemoryBegins = make([]int, importedCount)
+	for i := range vmOffsets.importedMemoryBegins {
+		v, err := readU64()
+		if err != nil {
+			return nil, err
+		}
+		vmOffsets.importedMemoryBegins[i] = int(v)
+	}
+
+	importedFunctionsBegin, err := readU64()
+	if err != nil {
+		return nil, err
+	}
+	vmOffsets.importedFunctionsBegin = int(importedFunctionsBegin)
+
+	execLen, err := readU64()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(raw)) < execLen {
+		return nil, fmt.Errorf("cranelift: truncated cache entry: missing executable bytes")
+	}
+
+	executable, err := platform.MmapCodeSegment(bytes.NewReader(raw[:execLen]), int(execLen))
+	if err != nil {
+		return nil, err
+	}
+
+	return &compiledModule{
+		executable:             executable,
+		executableOffsets:      executableOffsets,
+		opaqueVmContextOffsets: vmOffsets,
+		engine:                 e,
+		sourceHash:             sourceHash,
+	}, nil
+}
+
+// errCacheVersionMismatch is returned by LoadCompiledModule when a blob's header
+// doesn't match the current cache tag or the expected source hash; callers treat
+// this the same as a miss.
+var errCacheVersionMismatch = fmt.Errorf("cranelift: cache entry version/ABI/target mismatch")
+
+// loadCompiledModuleFromCache opens dir's blob for id, if any, and loads it via
+// LoadCompiledModule, rejecting it unless it matches sourceHash. ok is false on a
+// cache miss, version mismatch, source mismatch, or an unreadable or corrupt entry;
+// all of these are treated as a miss, so err is always nil.
+func (e *engine) loadCompiledModuleFromCache(ctx context.Context, id engineext.ModuleID, sourceHash [32]byte) (compiled *compiledModule, ok bool, err error) {
+	path := filepath.Join(e.compilationCacheDir, cacheFileName(id))
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, nil //nolint:nilerr // unreadable cache entry: treat as a miss, not fatal.
+	}
+	defer f.Close()
+
+	compiled, err = e.LoadCompiledModule(ctx, f, sourceHash)
+	if err == errCacheVersionMismatch {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, nil //nolint:nilerr // corrupt cache entry: treat as a miss, not fatal.
+	}
+	return compiled, true, nil
+}
+
+// storeCompiledModuleToCache atomically writes compiled to dir's blob for id via a
+// temp file + rename, so a crash mid-write never leaves a corrupt entry visible to a
+// future load.
+func (e *engine) storeCompiledModuleToCache(id engineext.ModuleID, compiled *compiledModule) error {
+	if err := os.MkdirAll(e.compilationCacheDir, 0o755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := e.SerializeCompiledModule(id, &buf); err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.compilationCacheDir, cacheFileName(id))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
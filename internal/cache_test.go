@@ -0,0 +1,60 @@
+package cranelift
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestLoadCompiledModule_RejectsImplausibleCount guards against a corrupt (or
+// crafted) cache entry whose executableOffsets count claims far more entries than
+// the blob could possibly contain, which would otherwise drive
+// make([]int, offsetCount) into a multi-GB allocation before the truncation was
+// ever detected.
+func TestLoadCompiledModule_RejectsImplausibleCount(t *testing.T) {
+	e := &engine{}
+
+	var buf bytes.Buffer
+	tag := cacheKeyTag()
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(tag))))
+	buf.WriteString(tag)
+	var sourceHash [32]byte
+	buf.Write(sourceHash[:])
+	// A count that claims billions of 8-byte entries despite no bytes following it.
+	buf.Write(binary.LittleEndian.AppendUint32(nil, 0xFFFFFFFF))
+
+	_, err := e.LoadCompiledModule(nil, &buf, sourceHash)
+	if err == nil {
+		t.Fatal("expected an error for an implausible executableOffsets count, got nil")
+	}
+}
+
+// TestLoadCompiledModule_RejectsSourceHashMismatch guards against a module ID being
+// reused across runs for a different wasm module: even a structurally well-formed,
+// version-matched blob must be rejected as a cache miss if its embedded source hash
+// doesn't match the module the caller is actually trying to compile, since otherwise
+// stale machine code for a different module would be mmap'd and executed.
+func TestLoadCompiledModule_RejectsSourceHashMismatch(t *testing.T) {
+	e := &engine{}
+
+	var buf bytes.Buffer
+	tag := cacheKeyTag()
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(tag))))
+	buf.WriteString(tag)
+	var storedHash [32]byte
+	storedHash[0] = 0xAA
+	buf.Write(storedHash[:])
+	buf.Write(binary.LittleEndian.AppendUint32(nil, 0)) // executableOffsets count
+	buf.Write(binary.LittleEndian.AppendUint64(nil, 0)) // opaqueVmContextOffsets.totalSize
+	buf.Write(binary.LittleEndian.AppendUint32(nil, 0)) // localMemoryBegins count
+	buf.Write(binary.LittleEndian.AppendUint32(nil, 0)) // importedMemoryBegins count
+	buf.Write(binary.LittleEndian.AppendUint64(nil, 0)) // importedFunctionsBegin
+	buf.Write(binary.LittleEndian.AppendUint64(nil, 0)) // executable length
+
+	var expectedHash [32]byte
+	expectedHash[0] = 0xBB
+	_, err := e.LoadCompiledModule(nil, &buf, expectedHash)
+	if err != errCacheVersionMismatch {
+		t.Fatalf("expected errCacheVersionMismatch for a source hash mismatch, got %v", err)
+	}
+}
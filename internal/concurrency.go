@@ -0,0 +1,18 @@
+package cranelift
+
+import "context"
+
+type compileConcurrencyKey struct{}
+
+// WithCompileConcurrency returns a context derived from ctx that configures the
+// number of Cranelift worker instances used to compile distinct functions of a
+// module in parallel. n must be positive; it defaults to runtime.GOMAXPROCS(0) when
+// this option isn't set.
+func WithCompileConcurrency(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, compileConcurrencyKey{}, n)
+}
+
+func compileConcurrencyFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(compileConcurrencyKey{}).(int)
+	return n, ok && n > 0
+}
@@ -3,11 +3,15 @@ package cranelift
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	_ "embed"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
 	"runtime"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/tetratelabs/wabin/leb128"
@@ -24,6 +28,12 @@ var craneliftBin []byte
 
 const craneliftFeature = api.CoreFeaturesV2
 
+// craneliftABIVersion must match the abi_version export of cranelift_backend.wasm.
+// Bump this whenever the host<->guest ABI changes (e.g. the memory callbacks below
+// gaining a memory index for multi-memory support) so that a stale or foreign blob
+// is rejected at engine startup instead of silently mis-executing.
+const craneliftABIVersion = 2
+
 // Compile-time objects.
 type (
 	// engine implements wasm.Engine.
@@ -32,9 +42,26 @@ type (
 		paramsSetupCodes         map[string][]byte
 		craneliftRuntime         wazero.Runtime
 		craneliftModule          wazero.CompiledModule
-		craneLiftInst            craneliftModuleInstance
+		craneLiftInsts           []*craneliftModuleInstance
 		pendingCompiledFunctions map[engineext.ModuleID][]pendingCompiledBody
-		vmctxs                   map[any]*vmContext
+		// pendingMu guards pendingCompiledFunctions, which is mutated concurrently
+		// by exportCompileDone callbacks from the worker pool compiling distinct
+		// functions of the same module in parallel.
+		pendingMu sync.Mutex
+		vmctxs    map[any]*vmContext
+
+		// compilationCacheDir, when non-empty, is consulted before compiling a
+		// module and written to after a successful compile. See WithCompilationCacheDir.
+		compilationCacheDir string
+
+		// compileConcurrency is the number of Cranelift worker instances used to
+		// compile distinct functions of a module in parallel. See WithCompileConcurrency.
+		compileConcurrency int
+
+		// callFramePools holds a *sync.Pool of *callFrame per (params, results)
+		// signature, so callEngine.Call can recycle stacks and results holders
+		// instead of allocating them on every invocation.
+		callFramePools sync.Map
 	}
 
 	// compiledModule holds the memory-mapped executable and the offsets inside it which maps
@@ -44,12 +71,27 @@ type (
 		executableOffsets      []int
 		opaqueVmContextOffsets opaqueVmContextOffsets
 		engine                 *engine
+		// isHostModule is true for a compiledModule built by compileHostModule. Such a
+		// module declares no functions (compileHostModule rejects any that do), so its
+		// executable is empty. Nothing in this package reads the field; it marks the
+		// module's origin for diagnostics.
+		isHostModule bool
+		// sourceHash identifies the wasm module this was compiled from; see
+		// moduleContentHash. It is embedded in a cache blob's header by
+		// SerializeCompiledModule and checked by LoadCompiledModule, so that a stale
+		// blob left behind by a module ID that got reused across runs is rejected as a
+		// cache miss instead of being mmap'd and executed as if it still matched.
+		sourceHash [32]byte
 	}
 
 	opaqueVmContextOffsets struct {
-		totalSize              int
-		localMemoryBegin       int
-		importedMemoryBegin    int
+		totalSize int
+		// localMemoryBegins holds, per local memory index, the offset of its
+		// {bufferPtr uint64; length uint64} pair. Empty if the module has none.
+		localMemoryBegins []int
+		// importedMemoryBegins holds, per imported memory index, the offset of its
+		// *wasm.MemoryInstance pointer. Empty if the module has none.
+		importedMemoryBegins   []int
 		importedFunctionsBegin int
 	}
 
@@ -59,6 +101,17 @@ type (
 	}
 
 	// functionRelocationEntry must be aligned with functionRelocationEntry in lib.rs.
+	// index identifies the callee function (see resolveFunctionExecutable) and
+	// offset is the byte offset of the direct-call instruction's operand within the
+	// caller's own machineCode. applyFunctionRelocations patches that operand to a
+	// PC-relative displacement between the two functions' final positions in the
+	// same mmap'd executable -- never an absolute address -- which is exactly why
+	// compiled.executable can be serialized to and mmap'd back from a cache entry
+	// verbatim: a fresh mmap address shifts every function in the blob by the same
+	// amount, so the relative displacements baked in here stay correct. If a future
+	// relocation kind ever needs to bake in something address-dependent (e.g. a
+	// vmctx pointer constant), compilationCacheVersion must bump alongside it so
+	// blobs written under the old assumption are rejected rather than mis-executed.
 	functionRelocationEntry struct{ index, offset uint32 }
 
 	craneliftModuleInstance struct {
@@ -83,6 +136,10 @@ type (
 		parent            *compiledModule
 		importedFunctions []vmContextImportedFunction
 		module            engineext.ModuleInstance
+		// importedMemoryOverrides holds, per imported memory index, a resolver-supplied
+		// *wasm.MemoryInstance pointer to wire in place of module.ImportedMemoryInstancePtr.
+		// A zero entry means "no override for this memory". See WithImportMemoryResolver.
+		importedMemoryOverrides []uintptr
 		// opaqueVmContext is the opaque byte slice of Wasm-compile-time-known Module instance specific contents whose size
 		// is only Wasm-compile-time known, hence dynamic. Its contents are basically the pointers to the module instance,
 		// specific objects as well as functions. This follows how Wasmtime defines its own VMContext.
@@ -97,31 +154,56 @@ type (
 	}
 
 	// callEngine implements wasm.CallEngine.
-	// This is created per exported function on demand.
+	// This is created per exported function on demand. The stack and results holder
+	// it needs per invocation live in a pooled *callFrame (see acquireCallFrame)
+	// rather than here, so that Call can recycle them across invocations instead of
+	// allocating on every hot-path call.
 	callEngine struct {
 		entry      entryPointFn
 		executable *byte
 
 		setParamsExecutable *byte
 
-		resultsHolderPtr *byte
-		resultsHolder    []byte
+		vmCtx    *vmContext
+		results  []api.ValueType
+		frameKey string
+	}
 
+	// callFrame holds the per-invocation scratch memory a callEngine needs: the
+	// native call stack and, for functions with results, the byte-encoded results
+	// holder. Frames are pooled per (params, results) signature so repeated calls to
+	// functions sharing a signature reuse the same backing memory.
+	callFrame struct {
 		stack           []byte
 		alignedStackTop uintptr
 
-		vmCtx   *vmContext
-		results []api.ValueType
+		resultsHolderPtr *byte
+		resultsHolder    []byte
 	}
 )
 
-func NewEngine(ctx context.Context, _ api.CoreFeatures, _ any) engineext.EngineExt {
+func NewEngine(ctx context.Context, features api.CoreFeatures, _ any) engineext.EngineExt {
+	if features&craneliftFeatureTypedContinuations != 0 {
+		// This engine has no continuation type and no stack-switching entry point
+		// (continuation.go defines only the feature bit), so refuse to start an
+		// engine that a caller has asked to support them, rather than silently
+		// accepting the bit and panicking the first time a guest hits cont.new/resume.
+		panic("cranelift: typed continuations (craneliftFeatureTypedContinuations) are not implemented by this engine yet")
+	}
+
 	e := &engine{
 		pendingCompiledFunctions: map[engineext.ModuleID][]pendingCompiledBody{},
 		modules:                  map[engineext.ModuleID]*compiledModule{},
 		paramsSetupCodes:         map[string][]byte{},
 		vmctxs:                   map[any]*vmContext{},
 	}
+	if dir, ok := cacheDirFromContext(ctx); ok {
+		e.compilationCacheDir = dir
+	}
+	e.compileConcurrency = runtime.GOMAXPROCS(0)
+	if n, ok := compileConcurrencyFromContext(ctx); ok {
+		e.compileConcurrency = n
+	}
 
 	craneliftRuntime := wazero.NewRuntime(ctx)
 	e.craneliftRuntime = craneliftRuntime
@@ -151,6 +233,16 @@ func NewEngine(ctx context.Context, _ api.CoreFeatures, _ any) engineext.EngineE
 	}
 }
 
+// wasiExitError is the panic value proc_exit raises to unwind out of the
+// Cranelift guest. wazero recovers a panicking host function and surfaces it as
+// the error returned from the exported function's Call, so this propagates all
+// the way out through compileFunction and CompileModule without any special-casing.
+type wasiExitError struct{ code uint32 }
+
+func (e wasiExitError) Error() string {
+	return fmt.Sprintf("cranelift: guest called proc_exit(%d)", e.code)
+}
+
 func (e *engine) addWASI(ctx context.Context) {
 	const wasiName = "wasi_snapshot_preview1"
 	_, err := e.craneliftRuntime.NewHostModuleBuilder(wasiName).
@@ -158,12 +250,13 @@ func (e *engine) addWASI(ctx context.Context) {
 		WithFunc(func(_ context.Context, mod api.Module, fd uint32, iovs uint32, iovsCount uint32, resultNwritten uint32) uint32 {
 			mem := mod.Memory()
 
+			inst := e.craneliftInstanceOf(mod)
 			var writer io.Writer
 			switch fd {
 			case 1:
-				writer = e.craneLiftInst.stdout
+				writer = inst.stdout
 			case 2:
-				writer = e.craneLiftInst.stderr
+				writer = inst.stderr
 			}
 
 			if writer == nil {
@@ -204,19 +297,57 @@ func (e *engine) addWASI(ctx context.Context) {
 			return 0
 		}).Export("fd_write").
 		NewFunctionBuilder().
-		WithFunc(func(uint32, uint64, uint32) uint32 { return 0 }).
+		WithFunc(func(_ context.Context, mod api.Module, _ uint32, _ uint64, resultTimestamp uint32) uint32 {
+			if !mod.Memory().WriteUint64Le(resultTimestamp, uint64(time.Now().UnixNano())) {
+				return 21 // ErrnoFault
+			}
+			return 0
+		}).
 		Export("clock_time_get").
 		NewFunctionBuilder().
-		WithFunc(func(uint32, uint32) uint32 { return 0 }).
+		WithFunc(func(_ context.Context, mod api.Module, buf, bufLen uint32) uint32 {
+			b, ok := mod.Memory().Read(buf, bufLen)
+			if !ok {
+				return 21 // ErrnoFault
+			}
+			if _, err := rand.Read(b); err != nil {
+				return 29 // ErrnoIo
+			}
+			return 0
+		}).
 		Export("random_get").
 		NewFunctionBuilder().
-		WithFunc(func(uint32, uint32) uint32 { return 0 }).
+		WithFunc(func(_ context.Context, mod api.Module, environPtr, environBufPtr uint32) uint32 {
+			mem := mod.Memory()
+			for _, e := range os.Environ() {
+				if !mem.WriteUint32Le(environPtr, environBufPtr) {
+					return 21 // ErrnoFault
+				}
+				environPtr += 4
+				if !mem.Write(environBufPtr, append([]byte(e), 0)) {
+					return 21 // ErrnoFault
+				}
+				environBufPtr += uint32(len(e) + 1)
+			}
+			return 0
+		}).
 		Export("environ_get").
 		NewFunctionBuilder().
-		WithFunc(func(uint32, uint32) uint32 { return 0 }).
+		WithFunc(func(_ context.Context, mod api.Module, resultCount, resultBufSize uint32) uint32 {
+			environ := os.Environ()
+			var bufSize uint32
+			for _, e := range environ {
+				bufSize += uint32(len(e) + 1)
+			}
+			mem := mod.Memory()
+			if !mem.WriteUint32Le(resultCount, uint32(len(environ))) || !mem.WriteUint32Le(resultBufSize, bufSize) {
+				return 21 // ErrnoFault
+			}
+			return 0
+		}).
 		Export("environ_sizes_get").
 		NewFunctionBuilder().
-		WithFunc(func(i uint32) { panic(i) }).
+		WithFunc(func(code uint32) { panic(wasiExitError{code: code}) }).
 		Export("proc_exit").
 		Instantiate(ctx)
 
@@ -225,19 +356,40 @@ func (e *engine) addWASI(ctx context.Context) {
 	}
 }
 
-func (e *engine) instantiateCraneLiftModule(ctx context.Context) (err error) {
-	e.craneLiftInst.stdout, e.craneLiftInst.stderr = bytes.NewBuffer(nil), bytes.NewBuffer(nil)
-	e.craneLiftInst.m, err = e.craneliftRuntime.InstantiateModule(ctx, e.craneliftModule, wazero.NewModuleConfig().
-		WithStderr(e.craneLiftInst.stderr).
-		WithStdout(e.craneLiftInst.stdout),
+// instantiateCraneLiftModule instantiates e.compileConcurrency independent copies of
+// the Cranelift wasm module, each with its own stdout/stderr buffers and memory, so
+// that distinct functions can be compiled on distinct instances concurrently.
+func (e *engine) instantiateCraneLiftModule(ctx context.Context) error {
+	e.craneLiftInsts = make([]*craneliftModuleInstance, e.compileConcurrency)
+	for i := range e.craneLiftInsts {
+		inst, err := e.newCraneliftModuleInstance(ctx)
+		if err != nil {
+			return err
+		}
+		e.craneLiftInsts[i] = inst
+	}
+	return nil
+}
+
+func (e *engine) newCraneliftModuleInstance(ctx context.Context) (*craneliftModuleInstance, error) {
+	inst := &craneliftModuleInstance{stdout: bytes.NewBuffer(nil), stderr: bytes.NewBuffer(nil)}
+	m, err := e.craneliftRuntime.InstantiateModule(ctx, e.craneliftModule, wazero.NewModuleConfig().
+		WithStderr(inst.stderr).
+		WithStdout(inst.stdout),
 	)
 	if err != nil {
-		return err
-	}
-	m := e.craneLiftInst.m
-	e.craneLiftInst.allocate = m.ExportedFunction("_allocate")
-	e.craneLiftInst.deallocate = m.ExportedFunction("_deallocate")
-	e.craneLiftInst.compileFunction = m.ExportedFunction("compile_function")
+		// A cranelift_backend.wasm blob old enough to predate this engine's host ABI
+		// (e.g. it still imports the pre-multi-memory memory_min_max/is_memory_imported
+		// signatures, or doesn't import table_element_write at all) fails right here
+		// with wazero's own, ABI-version-agnostic import-signature-mismatch error,
+		// before the abi_version check below ever runs. Wrap it so that the likely
+		// cause -- rather than an opaque link error -- is what the caller sees.
+		return nil, fmt.Errorf("failed to instantiate cranelift_backend.wasm against this engine's host ABI (wants version %d; is the embedded blob stale?): %w", craneliftABIVersion, err)
+	}
+	inst.m = m
+	inst.allocate = m.ExportedFunction("_allocate")
+	inst.deallocate = m.ExportedFunction("_deallocate")
+	inst.compileFunction = m.ExportedFunction("compile_function")
 
 	// This selection logic should be lined with WazeroTarget in targets.rs.
 	var kind uint64
@@ -249,9 +401,95 @@ func (e *engine) instantiateCraneLiftModule(ctx context.Context) (err error) {
 	}
 
 	if _, err = m.ExportedFunction("initialize_target").Call(ctx, kind); err != nil {
-		return fmt.Errorf("failed to initialize cranelift: %v\n%s", err, e.craneLiftInst.stderr.String())
+		return nil, fmt.Errorf("failed to initialize cranelift: %v\n%s", err, inst.stderr.String())
 	}
-	return
+
+	// abi_version must be present: any blob that reaches this line already satisfied
+	// the InstantiateModule call above against the current (v2+) "wazero" host module
+	// imports, so a missing export here would mean the blob is otherwise ABI-compatible
+	// by coincidence but was never updated to report its version -- reject rather than
+	// silently skip the check for it.
+	abiVersionFn := m.ExportedFunction("abi_version")
+	if abiVersionFn == nil {
+		return nil, fmt.Errorf("cranelift_backend.wasm predates abi_version (engine wants %d); rebuild it", craneliftABIVersion)
+	}
+	res, err := abiVersionFn.Call(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cranelift ABI version: %w", err)
+	}
+	if got := uint32(res[0]); got != craneliftABIVersion {
+		return nil, fmt.Errorf("cranelift_backend.wasm ABI version mismatch: engine wants %d, blob reports %d", craneliftABIVersion, got)
+	}
+	return inst, nil
+}
+
+// compileFunctionsConcurrently compiles every function of module across
+// e.compileConcurrency Cranelift worker instances, each pulling function indices off
+// a shared work queue. Results land in e.pendingCompiledFunctions[module.ModuleID()]
+// at the slot matching their local function index, which is pre-sized here so that
+// exportCompileDone can write into it regardless of completion order.
+func (e *engine) compileFunctionsConcurrently(module engineext.Module, vmOffsets *opaqueVmContextOffsets, importedFns uint32) error {
+	n := module.CodeCount()
+	id := module.ModuleID()
+
+	e.pendingMu.Lock()
+	e.pendingCompiledFunctions[id] = make([]pendingCompiledBody, n)
+	e.pendingMu.Unlock()
+
+	workers := e.compileConcurrency
+	if workers > int(n) {
+		workers = int(n)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	indices := make(chan uint32, n)
+	for i := uint32(0); i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		inst := e.craneLiftInsts[w]
+		wg.Add(1)
+		go func(inst *craneliftModuleInstance) {
+			defer wg.Done()
+			for i := range indices {
+				localTypes, body := module.CodeAt(i)
+				funcId := i + importedFns
+				cmpCtx := newCompilationContext(module, funcId, vmOffsets)
+				if err := e.compileFunction(cmpCtx, inst, localTypes, body); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(inst)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// craneliftInstanceOf returns the worker instance backing mod, which is the
+// api.Module a wazero host function callback was invoked with. Cranelift host
+// functions (WASI, the wazero module) are registered once but instantiated against
+// every worker, so callbacks must be routed back to their originating instance.
+func (e *engine) craneliftInstanceOf(mod api.Module) *craneliftModuleInstance {
+	for _, inst := range e.craneLiftInsts {
+		if inst.m == mod {
+			return inst
+		}
+	}
+	panic("BUG: callback from an unregistered cranelift module instance")
 }
 
 // Close implements wasm.Engine Close.
@@ -265,29 +503,37 @@ func (e *engine) Close() (err error) {
 }
 
 // CompileModule implements wasm.Engine CompileModule.
-func (e *engine) CompileModule(_ context.Context, _module any, _ []experimental.FunctionListener, _ bool) error {
+func (e *engine) CompileModule(ctx context.Context, _module any, _ []experimental.FunctionListener, _ bool) error {
 	module := MustUnwrapModule(_module)
 
 	if module.HostModule() {
-		panic("TODO")
+		return e.compileHostModule(module)
 	}
 
-	vmOffsets := getOpaqueVmContextOffsets(module)
+	id := module.ModuleID()
+	sourceHash := moduleContentHash(module)
 
-	importedFns := module.ImportFuncCount()
-	for i := uint32(0); i < module.CodeCount(); i++ {
-		localTypes, body := module.CodeAt(i)
-		funcId := i + importedFns
-		cmpCtx := newCompilationContext(module, funcId, &vmOffsets)
-		err := e.compileFunction(cmpCtx, localTypes, body)
+	if e.compilationCacheDir != "" {
+		compiled, ok, err := e.loadCompiledModuleFromCache(ctx, id, sourceHash)
 		if err != nil {
 			return err
 		}
+		if ok {
+			e.registerCompiledModule(id, compiled)
+			return nil
+		}
 	}
 
-	// TODO: take lock.
-	id := module.ModuleID()
+	vmOffsets := getOpaqueVmContextOffsets(module)
+	importedFns := module.ImportFuncCount()
+
+	if err := e.compileFunctionsConcurrently(module, &vmOffsets, importedFns); err != nil {
+		return err
+	}
+
+	e.pendingMu.Lock()
 	compiledFns, ok := e.pendingCompiledFunctions[id]
+	e.pendingMu.Unlock()
 	if !ok {
 		panic("BUG")
 	}
@@ -316,10 +562,30 @@ func (e *engine) CompileModule(_ context.Context, _module any, _ []experimental.
 		executableOffsets:      executableOffsets,
 		engine:                 e,
 		opaqueVmContextOffsets: vmOffsets,
+		sourceHash:             sourceHash,
+	}
+	e.registerCompiledModule(id, compiledMod)
+
+	e.pendingMu.Lock()
+	delete(e.pendingCompiledFunctions, id)
+	e.pendingMu.Unlock()
+
+	if e.compilationCacheDir != "" {
+		// The module is already compiled and registered at this point: a failure to
+		// persist it to the cache (disk full, permissions) shouldn't turn an
+		// otherwise-successful compile into a hard error for the caller, since the
+		// cache is a strictly opt-in speed-up and the next compile can just retry it.
+		_ = e.storeCompiledModuleToCache(id, compiledMod)
 	}
-	e.modules[id] = compiledMod
+	return nil
+}
 
-	runtime.SetFinalizer(compiledMod, func(c *compiledModule) {
+// registerCompiledModule installs compiled as the engine's module for id and arranges
+// for its mmap'd executable to be released once it's no longer reachable, regardless
+// of whether compiled came from a fresh compile or from the on-disk cache.
+func (e *engine) registerCompiledModule(id engineext.ModuleID, compiled *compiledModule) {
+	e.modules[id] = compiled
+	runtime.SetFinalizer(compiled, func(c *compiledModule) {
 		executable := c.executable
 		if executable == nil {
 			return // already released
@@ -331,14 +597,10 @@ func (e *engine) CompileModule(_ context.Context, _module any, _ []experimental.
 			panic("compiler: failed to munmap executable")
 		}
 	})
-
-	// TODO: take lock.
-	delete(e.pendingCompiledFunctions, id)
-	return nil
 }
 
-func (e *engine) compileFunction(ctx context.Context, localTypes []api.ValueType, body []byte) (err error) {
-	m := e.craneLiftInst.m.Memory()
+func (e *engine) compileFunction(ctx context.Context, inst *craneliftModuleInstance, localTypes []api.ValueType, body []byte) (err error) {
+	m := inst.m.Memory()
 
 	// Allocate the function body inside the cranelift module.
 	locals := len(localTypes)
@@ -346,7 +608,7 @@ func (e *engine) compileFunction(ctx context.Context, localTypes []api.ValueType
 
 	// TODO: export wasm.encodeCode and reuse it here.
 	bodySize := uint64(len(body) + len(localNumLeb128) + locals*2)
-	_raw, err := e.craneLiftInst.allocate.Call(ctx, bodySize)
+	_raw, err := inst.allocate.Call(ctx, bodySize)
 	if err != nil {
 		return err
 	}
@@ -364,7 +626,7 @@ func (e *engine) compileFunction(ctx context.Context, localTypes []api.ValueType
 	m.Write(offset, body)
 
 	// Now ready to call compile_function with the allocated body.
-	_, err = e.craneLiftInst.compileFunction.Call(ctx, offset64, bodySize)
+	_, err = inst.compileFunction.Call(ctx, offset64, bodySize)
 	if err != nil {
 		return err
 	}
@@ -381,21 +643,47 @@ func (e *engine) DeleteCompiledModule(_m any) {
 }
 
 // NewModuleEngine implements wasm.Engine NewModuleEngine.
-func (e *engine) NewModuleEngine(name string, _m any, _mi any) (engineext.ModuleEngineExt, error) {
+func (e *engine) NewModuleEngine(ctx context.Context, name string, _m any, _mi any) (engineext.ModuleEngineExt, error) {
 	m, mi := MustUnwrapModule(_m), MustUnwrapModuleInstance(_mi)
 
 	imported := int(m.ImportFuncCount())
 	vmctx := &vmContext{importedFunctions: make([]vmContextImportedFunction, imported)}
 
+	resolver, hasResolver := importResolverFromContext(ctx)
+
 	importedModuleInstances, importedFuncIndexes := mi.ImportedFunctions()
 	for i := range importedModuleInstances {
 		imi, idx := importedModuleInstances[i], importedFuncIndexes[i]
+		storage := &vmctx.importedFunctions[i]
+
+		if hasResolver {
+			// A host-supplied resolver is consulted first so that the same compiled
+			// module can be wired to different call targets per instantiation
+			// without recompiling it. Functions it doesn't care about fall through
+			// to the statically-linked target below.
+			modName, funcName := m.ImportedFunctionModuleAndName(engineext.Index(i))
+			if resolved := resolver(modName, funcName); resolved != nil {
+				resolvedModuleInstance, resolvedIndex := MustUnwrapExportedFunction(resolved)
+				resolvedVmCtx, ok := e.vmctxs[resolvedModuleInstance]
+				if !ok {
+					// The resolver claimed this import but named a module instance this
+					// engine never compiled/instantiated: report it instead of silently
+					// falling back to the statically-linked target, since that would mask
+					// a resolver bug (typo'd module name, stale instance) as a no-op.
+					return engineext.ModuleEngineExt{}, fmt.Errorf(
+						"import resolver for %s.%s returned a function from an unrecognized module instance", modName, funcName)
+				}
+				storage.vmctx = resolvedVmCtx
+				storage.executable = resolvedVmCtx.resolveFunctionExecutable(resolvedIndex)
+				continue
+			}
+		}
+
 		importedVmCtx, ok := e.vmctxs[imi]
 		if !ok {
 			panic("BUG")
 		}
 		executable := importedVmCtx.resolveFunctionExecutable(idx)
-		storage := &vmctx.importedFunctions[i]
 		storage.vmctx = importedVmCtx
 		storage.executable = executable
 	}
@@ -406,6 +694,18 @@ func (e *engine) NewModuleEngine(name string, _m any, _mi any) (engineext.Module
 			fmt.Errorf("source module for %s must be compiled before instantiation", name)
 	}
 
+	if memResolver, hasMemResolver := importMemoryResolverFromContext(ctx); hasMemResolver {
+		if n := m.ImportedMemoriesCount(); n > 0 {
+			vmctx.importedMemoryOverrides = make([]uintptr, n)
+			for i := uint32(0); i < n; i++ {
+				modName, memName := m.ImportedMemoryModuleAndName(engineext.Index(i))
+				if resolved := memResolver(modName, memName); resolved != nil {
+					vmctx.importedMemoryOverrides[i] = mustUnwrapMemoryInstancePtr(resolved)
+				}
+			}
+		}
+	}
+
 	vmctx.parent = compiled
 	vmctx.module = mi
 	vmctx.buildOpaqueVMContext()
@@ -432,39 +732,50 @@ func getOpaqueVmContextOffsets(m engineext.Module) opaqueVmContextOffsets {
 	// opaqueVmContext has the following memory representation:
 	//
 	// type opaqueVmContext struct {
-	//     localMemoryBufferPtr                      *byte   (optional)
-	//     localMemoryLength                         uint64  (optional)
-	//     importedMemoryVmContext                   *byte   (optional)
-	//     importedMemoryVmContextMemoryBufferOffset uint64  (optional)
+	//     localMemories [LocalMemoriesCount()] struct {
+	//         bufferPtr *byte
+	//         length    uint64
+	//     }
+	//     importedMemories [ImportedMemoriesCount()] struct {
+	//         vmContext *byte // *wasm.MemoryInstance
+	//     }
 	//     importedFunctions [len(vm.importedFunctions)] struct { the total size depends on # of imported functions.
 	//         executable  *bytes
 	//         opaqueVmCtx *byte
 	//     }
 	//     TODO: add more fields
 	// }
+	//
+	// Multi-memory support means both localMemories and importedMemories may hold
+	// more than one entry; vm_context_local_memory_offset/vm_context_imported_memory_offset
+	// take the memory index to locate the right one. That index is always *global*
+	// (imported memories first, then local ones), matching memory_min_max and
+	// is_memory_imported; exportVmContextLocalMemoryOffset converts it to the
+	// per-class index localMemoryBegins is keyed by.
 
 	ret := opaqueVmContextOffsets{}
 	var offset int
-	if m.LocalMemoriesCount() > 0 {
-		// buffer base + memory size.
-		const localMemorySizeInOpaqueVMContext = 16
-		ret.localMemoryBegin = offset
-		offset += localMemorySizeInOpaqueVMContext
-		ret.totalSize += localMemorySizeInOpaqueVMContext
-	} else {
-		// Indicates that there's no local memory
-		ret.localMemoryBegin = -1
+
+	// buffer base + memory size, per local memory.
+	const localMemorySizeInOpaqueVMContext = 16
+	if n := m.LocalMemoriesCount(); n > 0 {
+		ret.localMemoryBegins = make([]int, n)
+		for i := range ret.localMemoryBegins {
+			ret.localMemoryBegins[i] = offset
+			offset += localMemorySizeInOpaqueVMContext
+			ret.totalSize += localMemorySizeInOpaqueVMContext
+		}
 	}
 
-	if m.ImportedMemoriesCount() > 0 {
-		// *wasm.MemoryInstance
-		const importedMemorySizeInOpaqueVMCContext = 8
-		ret.importedMemoryBegin = offset
-		offset += importedMemorySizeInOpaqueVMCContext
-		ret.totalSize += importedMemorySizeInOpaqueVMCContext
-	} else {
-		// Indicates that there's no imported memory
-		ret.importedMemoryBegin = -1
+	// *wasm.MemoryInstance, per imported memory.
+	const importedMemorySizeInOpaqueVMCContext = 8
+	if n := m.ImportedMemoriesCount(); n > 0 {
+		ret.importedMemoryBegins = make([]int, n)
+		for i := range ret.importedMemoryBegins {
+			ret.importedMemoryBegins[i] = offset
+			offset += importedMemorySizeInOpaqueVMCContext
+			ret.totalSize += importedMemorySizeInOpaqueVMCContext
+		}
 	}
 
 	ret.importedFunctionsBegin = offset
@@ -484,17 +795,21 @@ func (vm *vmContext) buildOpaqueVMContext() {
 	vm.opaqueVmContext = make([]byte, vmOffsets.totalSize)
 	vm.opaqueVmContextPtr = &vm.opaqueVmContext[0]
 
-	if vmOffsets.localMemoryBegin >= 0 {
-		memBuf := vm.module.MemoryInstanceBuffer()
-		binary.LittleEndian.PutUint64(vm.opaqueVmContext[vmOffsets.localMemoryBegin:],
+	for i, begin := range vmOffsets.localMemoryBegins {
+		memBuf := vm.module.MemoryInstanceBuffer(uint32(i))
+		binary.LittleEndian.PutUint64(vm.opaqueVmContext[begin:],
 			uint64(uintptr(unsafe.Pointer(&memBuf))))
-		binary.LittleEndian.PutUint64(vm.opaqueVmContext[vmOffsets.localMemoryBegin+8:],
+		binary.LittleEndian.PutUint64(vm.opaqueVmContext[begin+8:],
 			uint64(len(memBuf)))
 	}
 
-	if vmOffsets.importedMemoryBegin >= 0 {
-		ptr := vm.module.ImportedMemoryInstancePtr()
-		binary.LittleEndian.PutUint64(vm.opaqueVmContext[vmOffsets.importedMemoryBegin:], uint64(ptr))
+	for i, begin := range vmOffsets.importedMemoryBegins {
+		ptr := vm.module.ImportedMemoryInstancePtr(uint32(i))
+		if i < len(vm.importedMemoryOverrides) && vm.importedMemoryOverrides[i] != 0 {
+			// A host-supplied resolver claimed this memory; see WithImportMemoryResolver.
+			ptr = vm.importedMemoryOverrides[i]
+		}
+		binary.LittleEndian.PutUint64(vm.opaqueVmContext[begin:], uint64(ptr))
 	}
 
 	offset := vmOffsets.importedFunctionsBegin
@@ -525,23 +840,15 @@ func (vm *vmContext) NewCallEngine(callCtx any, _f any) (engineext.CallEngineExt
 		// return vm.NewCallEngine(callCtx, f)
 	}
 
-	s := make([]byte, initialStackSizeInBytes)
-	aligned := alignedStackTop(s)
 	entry := getEntryPoint(params, results)
 	ce := &callEngine{
-		entry:           entry,
-		stack:           s,
-		alignedStackTop: aligned,
-		vmCtx:           vm,
-		results:         results,
-		executable:      vm.resolveFunctionExecutable(f.Index()),
+		entry:      entry,
+		vmCtx:      vm,
+		results:    results,
+		executable: vm.resolveFunctionExecutable(f.Index()),
+		frameKey:   callFrameSignature(params, results),
 	}
 
-	if len(results) > 0 {
-		resultsHolder := make([]byte, len(results)*8 /* in bytes */) // TODO: v128.
-		ce.resultsHolder = resultsHolder
-		ce.resultsHolderPtr = &resultsHolder[0]
-	}
 	if len(params) > 0 {
 		executable, err := vm.parent.engine.paramSetupFn(params, results)
 		if err != nil {
@@ -552,18 +859,25 @@ func (vm *vmContext) NewCallEngine(callCtx any, _f any) (engineext.CallEngineExt
 	return ce.Call, nil
 }
 
-// LookupFunction implements wasm.ModuleEngine LookupFunction.
+// LookupFunction implements wasm.ModuleEngine LookupFunction. This engine doesn't
+// model tables yet (see exportTableElementWrite), so there is nothing at
+// tableOffset to look up; a real implementation would resolve the table element's
+// function reference and check it against typeId.
 func (vm *vmContext) LookupFunction(t any, typeId uint32, tableOffset engineext.Index) (idx engineext.Index, err error) {
-	panic("TODO")
+	panic(errTableSupportUnimplemented)
 }
 
 // CreateFuncElementInstance implements wasm.ModuleEngine CreateFuncElementInstance.
+// Deliberately unimplemented alongside LookupFunction: see its comment.
 func (vm *vmContext) GetFunctionReferences(indexes []*engineext.Index) []engineext.Reference {
-	panic("TODO")
+	panic(errTableSupportUnimplemented)
 }
 
 // FunctionInstanceReference implements wasm.ModuleEngine FunctionInstanceReference.
-func (vm *vmContext) FunctionInstanceReference(funcIndex wasm.Index) wasm.Reference { panic("TODO") }
+// Deliberately unimplemented alongside LookupFunction: see its comment.
+func (vm *vmContext) FunctionInstanceReference(funcIndex wasm.Index) wasm.Reference {
+	panic(errTableSupportUnimplemented)
+}
 
 // String implements fmt.Stringer.
 func (f functionRelocationEntry) String() string {
@@ -572,18 +886,64 @@ func (f functionRelocationEntry) String() string {
 
 // Call implements wasm.CallEngine Call.
 func (ce *callEngine) Call(ctx context.Context, _ any, params []uint64) (results []uint64, err error) {
+	e := ce.vmCtx.parent.engine
+	frame := e.acquireCallFrame(ce.frameKey, ce.results)
+	defer e.releaseCallFrame(ce.frameKey, frame)
+
 	if len(params) > 0 {
-		ce.entry(ce.vmCtx.opaqueVmContextPtr, ce.executable, ce.alignedStackTop, ce.resultsHolderPtr, ce.setParamsExecutable, &params[0])
+		ce.entry(ce.vmCtx.opaqueVmContextPtr, ce.executable, frame.alignedStackTop, frame.resultsHolderPtr, ce.setParamsExecutable, &params[0])
 	} else {
-		ce.entry(ce.vmCtx.opaqueVmContextPtr, ce.executable, ce.alignedStackTop, ce.resultsHolderPtr, nil, nil)
+		ce.entry(ce.vmCtx.opaqueVmContextPtr, ce.executable, frame.alignedStackTop, frame.resultsHolderPtr, nil, nil)
 	}
 
-	if len(ce.resultsHolder) > 0 {
-		results = ce.getResults()
+	if len(frame.resultsHolder) > 0 {
+		results = getResults(ce.results, frame.resultsHolder)
 	}
 	return
 }
 
+// callFrameSignature identifies a (params, results) function signature for the
+// purposes of keying callFrame pools: frames are only interchangeable between calls
+// whose results holder layout matches.
+func callFrameSignature(params, results []api.ValueType) string {
+	return fmt.Sprintf("%v|%v", params, results)
+}
+
+// newCallFrame allocates a callFrame sized for results: an initialStackSizeInBytes
+// stack plus, if results is non-empty, a byte-encoded results holder.
+func newCallFrame(results []api.ValueType) *callFrame {
+	s := make([]byte, initialStackSizeInBytes)
+	f := &callFrame{stack: s, alignedStackTop: alignedStackTop(s)}
+	if len(results) > 0 {
+		f.resultsHolder = make([]byte, len(results)*8 /* in bytes */) // TODO: v128.
+		f.resultsHolderPtr = &f.resultsHolder[0]
+	}
+	return f
+}
+
+// acquireCallFrame returns a *callFrame usable for the given signature, reusing one
+// from the corresponding pool when available and allocating one sized for results
+// otherwise. The pool itself is only constructed once per signature (on the first
+// call); every call after that hits the fast Load path instead of heap-allocating a
+// throwaway *sync.Pool and closure just to discard it.
+func (e *engine) acquireCallFrame(signature string, results []api.ValueType) *callFrame {
+	poolAny, ok := e.callFramePools.Load(signature)
+	if !ok {
+		pool := &sync.Pool{New: func() any { return newCallFrame(results) }}
+		poolAny, _ = e.callFramePools.LoadOrStore(signature, pool)
+	}
+	return poolAny.(*sync.Pool).Get().(*callFrame)
+}
+
+// releaseCallFrame returns f to the pool for signature so a future call can reuse it.
+func (e *engine) releaseCallFrame(signature string, f *callFrame) {
+	poolAny, ok := e.callFramePools.Load(signature)
+	if !ok {
+		return // BUG-proofing: should always have been stored by acquireCallFrame.
+	}
+	poolAny.(*sync.Pool).Put(f)
+}
+
 // alignedStackTop returns 16-bytes aligned stack top of given stack.
 // 16 bytes should be good for all platform (arm64/amd64).
 func alignedStackTop(s []byte) uintptr {
@@ -591,18 +951,17 @@ func alignedStackTop(s []byte) uintptr {
 	return stackAddr - (stackAddr & (16 - 1))
 }
 
-// getResults retrieves u64 represented results from the byte-represented callEngine.resultsHolder.
-func (ce *callEngine) getResults() (ret []uint64) {
-	resultTypes := ce.results
+// getResults retrieves u64 represented results from a byte-represented results holder.
+func getResults(resultTypes []api.ValueType, resultsHolder []byte) (ret []uint64) {
 	ret = make([]uint64, len(resultTypes))
 	offset := 0
 	for i, vt := range resultTypes {
 		switch vt {
 		case wasm.ValueTypeI32, wasm.ValueTypeF32:
-			ret[i] = uint64(binary.LittleEndian.Uint32(ce.resultsHolder[offset : offset+4]))
+			ret[i] = uint64(binary.LittleEndian.Uint32(resultsHolder[offset : offset+4]))
 			offset += 4
 		case wasm.ValueTypeI64, wasm.ValueTypeF64:
-			ret[i] = binary.LittleEndian.Uint64(ce.resultsHolder[offset : offset+8])
+			ret[i] = binary.LittleEndian.Uint64(resultsHolder[offset : offset+8])
 			offset += 8
 		default:
 			panic("TODO")
@@ -0,0 +1,181 @@
+package cranelift
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazerolift/internal/wazero/engineext"
+)
+
+// fakeModule is a minimal engineext.Module double: it declares one imported
+// function and no memories, which is all NewModuleEngine's resolver path touches.
+type fakeModule struct {
+	id               engineext.ModuleID
+	importFuncModule string
+	importFuncName   string
+}
+
+func (m *fakeModule) ModuleID() engineext.ModuleID { return m.id }
+func (m *fakeModule) CodeCount() uint32            { return 0 }
+func (m *fakeModule) CodeAt(uint32) ([]api.ValueType, []byte) {
+	panic("not used by this test")
+}
+func (m *fakeModule) HostModule() bool        { return false }
+func (m *fakeModule) ImportFuncCount() uint32 { return 1 }
+func (m *fakeModule) ImportedFunctionModuleAndName(engineext.Index) (string, string) {
+	return m.importFuncModule, m.importFuncName
+}
+func (m *fakeModule) ImportedMemoryModuleAndName(engineext.Index) (string, string) {
+	return "", ""
+}
+func (m *fakeModule) LocalMemoriesCount() uint32    { return 0 }
+func (m *fakeModule) ImportedMemoriesCount() uint32 { return 0 }
+func (m *fakeModule) FuncTypeIndex(uint32) uint32   { panic("not used by this test") }
+func (m *fakeModule) TypeCounts() uint32            { panic("not used by this test") }
+func (m *fakeModule) Type(uint32) ([]api.ValueType, []api.ValueType) {
+	panic("not used by this test")
+}
+func (m *fakeModule) MemoryMinMax(uint32) (uint32, uint32, bool) {
+	panic("not used by this test")
+}
+func (m *fakeModule) HostFunctionCount() uint32 { return 0 }
+func (m *fakeModule) HostFunctionAt(uint32) (api.GoModuleFunction, []api.ValueType, []api.ValueType) {
+	panic("not used by this test")
+}
+
+// fakeModuleInstance is a minimal engineext.ModuleInstance double. Its identity (as
+// a pointer) is what e.vmctxs is keyed by, mirroring how NewModuleEngine is called
+// once per real wasm.ModuleInstance.
+type fakeModuleInstance struct {
+	name                string
+	importedModuleInsts []any
+	importedFuncIndexes []engineext.Index
+}
+
+func (mi *fakeModuleInstance) ImportedFunctions() ([]any, []engineext.Index) {
+	return mi.importedModuleInsts, mi.importedFuncIndexes
+}
+func (mi *fakeModuleInstance) MemoryInstanceBuffer(uint32) []byte { panic("not used by this test") }
+func (mi *fakeModuleInstance) ImportedMemoryInstancePtr(uint32) uintptr {
+	panic("not used by this test")
+}
+func (mi *fakeModuleInstance) ModuleInstanceName() string { return mi.name }
+
+// fakeExportedFunction is what an ImportResolverFunc hands back: enough of
+// api.Function to type-check, plus engineext.ExportedFunction so
+// MustUnwrapExportedFunction can recover the module instance/index it names.
+type fakeExportedFunction struct {
+	moduleInstance any
+	index          engineext.Index
+}
+
+func (f *fakeExportedFunction) Definition() api.FunctionDefinition { return nil }
+func (f *fakeExportedFunction) Call(context.Context, ...uint64) ([]uint64, error) {
+	panic("not used by this test")
+}
+func (f *fakeExportedFunction) CallWithStack(context.Context, []uint64) error {
+	panic("not used by this test")
+}
+func (f *fakeExportedFunction) ModuleInstance() any    { return f.moduleInstance }
+func (f *fakeExportedFunction) Index() engineext.Index { return f.index }
+
+// newTestVMContext wires a compiledModule with a single function at executable[0]
+// directly into e, as if CompileModule and one NewModuleEngine instantiation had
+// already run for it, without needing a real Cranelift compile. executable aliases
+// executableByte, so &executable[0] == executableByte.
+func newTestVMContext(e *engine, id engineext.ModuleID, mi any, executableByte *byte) *vmContext {
+	compiled := &compiledModule{executable: unsafe.Slice(executableByte, 1), executableOffsets: []int{0}}
+	e.modules[id] = compiled
+	vmctx := &vmContext{parent: compiled}
+	e.vmctxs[mi] = vmctx
+	return vmctx
+}
+
+// TestNewModuleEngine_ImportResolver_SwitchesCallTargetWithoutRecompiling covers
+// the scenario WithImportResolver was added for: the same compiled caller module is
+// instantiated twice with different resolvers, and each instantiation's imported
+// function slot ends up pointing at a different callee -- with no second compile.
+func TestNewModuleEngine_ImportResolver_SwitchesCallTargetWithoutRecompiling(t *testing.T) {
+	e := &engine{
+		modules: map[engineext.ModuleID]*compiledModule{},
+		vmctxs:  map[any]*vmContext{},
+	}
+
+	calleeAByte, calleeBByte := byte(0xAA), byte(0xBB)
+	calleeAInst, calleeBInst := &fakeModuleInstance{name: "callee_a"}, &fakeModuleInstance{name: "callee_b"}
+	newTestVMContext(e, engineext.ModuleID(1), calleeAInst, &calleeAByte)
+	newTestVMContext(e, engineext.ModuleID(2), calleeBInst, &calleeBByte)
+
+	caller := &fakeModule{id: engineext.ModuleID(3), importFuncModule: "host", importFuncName: "cb"}
+	e.modules[caller.id] = &compiledModule{
+		executable:             []byte{0xCC},
+		executableOffsets:      []int{0},
+		opaqueVmContextOffsets: opaqueVmContextOffsets{importedFunctionsBegin: 0, totalSize: 16},
+	}
+
+	resolverTo := func(target *fakeModuleInstance, idx engineext.Index) ImportResolverFunc {
+		return func(module, name string) api.Function {
+			if module == "host" && name == "cb" {
+				return &fakeExportedFunction{moduleInstance: target, index: idx}
+			}
+			return nil
+		}
+	}
+
+	callerInst1 := &fakeModuleInstance{name: "caller#1", importedModuleInsts: []any{nil}, importedFuncIndexes: []engineext.Index{0}}
+	ctx1 := WithImportResolver(context.Background(), resolverTo(calleeAInst, 0))
+	if _, err := e.NewModuleEngine(ctx1, "caller#1", caller, callerInst1); err != nil {
+		t.Fatalf("NewModuleEngine (resolver A): %v", err)
+	}
+
+	callerInst2 := &fakeModuleInstance{name: "caller#2", importedModuleInsts: []any{nil}, importedFuncIndexes: []engineext.Index{0}}
+	ctx2 := WithImportResolver(context.Background(), resolverTo(calleeBInst, 0))
+	if _, err := e.NewModuleEngine(ctx2, "caller#2", caller, callerInst2); err != nil {
+		t.Fatalf("NewModuleEngine (resolver B): %v", err)
+	}
+
+	vmctx1, vmctx2 := e.vmctxs[callerInst1], e.vmctxs[callerInst2]
+	if vmctx1.parent != vmctx2.parent {
+		t.Fatalf("expected both instantiations to reuse the same compiled module, got %p and %p", vmctx1.parent, vmctx2.parent)
+	}
+	if got, want := vmctx1.importedFunctions[0].executable, &calleeAByte; got != want {
+		t.Errorf("instantiation 1: executable = %p, want %p (callee A)", got, want)
+	}
+	if got, want := vmctx2.importedFunctions[0].executable, &calleeBByte; got != want {
+		t.Errorf("instantiation 2: executable = %p, want %p (callee B)", got, want)
+	}
+	if vmctx1.importedFunctions[0].executable == vmctx2.importedFunctions[0].executable {
+		t.Error("expected the two resolvers to produce different call targets, got the same one")
+	}
+}
+
+// TestNewModuleEngine_ImportResolver_UnrecognizedModuleInstance_Errors covers the
+// case where a resolver claims an import (returns non-nil) but names a module
+// instance this engine never instantiated: that must surface as an error, not
+// silently fall through to the statically-linked target.
+func TestNewModuleEngine_ImportResolver_UnrecognizedModuleInstance_Errors(t *testing.T) {
+	e := &engine{
+		modules: map[engineext.ModuleID]*compiledModule{},
+		vmctxs:  map[any]*vmContext{},
+	}
+
+	caller := &fakeModule{id: engineext.ModuleID(1), importFuncModule: "host", importFuncName: "cb"}
+	e.modules[caller.id] = &compiledModule{
+		executable:             []byte{0xCC},
+		executableOffsets:      []int{0},
+		opaqueVmContextOffsets: opaqueVmContextOffsets{importedFunctionsBegin: 0, totalSize: 16},
+	}
+
+	unknownInst := &fakeModuleInstance{name: "unknown"}
+	resolver := func(module, name string) api.Function {
+		return &fakeExportedFunction{moduleInstance: unknownInst, index: 0}
+	}
+
+	callerInst := &fakeModuleInstance{name: "caller", importedModuleInsts: []any{nil}, importedFuncIndexes: []engineext.Index{0}}
+	ctx := WithImportResolver(context.Background(), resolver)
+	if _, err := e.NewModuleEngine(ctx, "caller", caller, callerInst); err == nil {
+		t.Fatal("expected an error for a resolver hit naming an unrecognized module instance, got nil")
+	}
+}
@@ -0,0 +1,37 @@
+package cranelift
+
+import (
+	"fmt"
+
+	"github.com/tetratelabs/wazerolift/internal/wazero/engineext"
+)
+
+// errHostModuleUnsupported is returned by compileHostModule for any host module
+// that declares at least one function. Calling a Go-backed host function from
+// Cranelift-compiled code requires a machine-code trampoline that marshals the
+// Cranelift calling convention's stack frame into a []uint64 of params, invokes the
+// user's api.GoModuleFunction, and spills the results back into the caller's
+// results holder; that codegen doesn't exist yet for any architecture, so compiling
+// such a module is refused up front rather than accepted and left to panic the
+// first time the guest actually calls in.
+var errHostModuleUnsupported = fmt.Errorf("cranelift: host modules with functions are not supported by this engine yet")
+
+// compileHostModule builds a *compiledModule for a Go-backed host module, i.e. one
+// created via wazero.NewHostModuleBuilder. There is no wasm to hand to Cranelift
+// here, so each host function would need its own machine-code trampoline, laid out
+// in executableOffsets exactly like compiled wasm bodies, so resolveFunctionExecutable
+// and the imported-function slot machinery in buildOpaqueVMContext keep working
+// unchanged for a compiled wasm module that imports a host function. Until that
+// trampoline codegen exists, a host module with any functions is rejected outright;
+// only an empty host module (e.g. one that exports nothing callable) compiles.
+func (e *engine) compileHostModule(module engineext.Module) error {
+	if n := module.HostFunctionCount(); n > 0 {
+		return fmt.Errorf("cranelift: host module %v declares %d function(s): %w", module.ModuleID(), n, errHostModuleUnsupported)
+	}
+
+	e.registerCompiledModule(module.ModuleID(), &compiledModule{
+		engine:       e,
+		isHostModule: true,
+	})
+	return nil
+}
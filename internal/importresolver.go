@@ -0,0 +1,46 @@
+package cranelift
+
+import (
+	"context"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ImportResolverFunc resolves an import by its declared module and name to a
+// concrete function, mirroring wazero's experimental.ImportResolver. Returning nil
+// falls through to the statically-linked target baked in at compile time.
+type ImportResolverFunc func(module, name string) api.Function
+
+type importResolverKey struct{}
+
+// WithImportResolver returns a context derived from ctx that, when passed to
+// wazero.Runtime's InstantiateModule, is consulted before wiring a compiled
+// module's imported functions so the same compiled module can be instantiated with
+// different call targets without recompiling it.
+func WithImportResolver(ctx context.Context, resolver ImportResolverFunc) context.Context {
+	return context.WithValue(ctx, importResolverKey{}, resolver)
+}
+
+func importResolverFromContext(ctx context.Context) (ImportResolverFunc, bool) {
+	resolver, ok := ctx.Value(importResolverKey{}).(ImportResolverFunc)
+	return resolver, ok && resolver != nil
+}
+
+// ImportMemoryResolverFunc resolves an imported memory by its declared module and
+// name to a concrete memory, mirroring ImportResolverFunc for functions. Returning
+// nil falls through to the statically-linked target baked in at compile time.
+type ImportMemoryResolverFunc func(module, name string) api.Memory
+
+type importMemoryResolverKey struct{}
+
+// WithImportMemoryResolver returns a context derived from ctx that, when passed to
+// wazero.Runtime's InstantiateModule, is consulted before wiring a compiled
+// module's imported memories, just as WithImportResolver is for imported functions.
+func WithImportMemoryResolver(ctx context.Context, resolver ImportMemoryResolverFunc) context.Context {
+	return context.WithValue(ctx, importMemoryResolverKey{}, resolver)
+}
+
+func importMemoryResolverFromContext(ctx context.Context) (ImportMemoryResolverFunc, bool) {
+	resolver, ok := ctx.Value(importMemoryResolverKey{}).(ImportMemoryResolverFunc)
+	return resolver, ok && resolver != nil
+}
@@ -1,6 +1,11 @@
 package cranelift
 
-import "github.com/tetratelabs/wazerolift/internal/wazero/engineext"
+import (
+	"unsafe"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazerolift/internal/wazero/engineext"
+)
 
 func MustUnwrapModule(raw any) engineext.Module {
 	return raw.(engineext.Module)
@@ -13,3 +18,26 @@ func MustUnwrapModuleInstance(raw any) engineext.ModuleInstance {
 func MustUnwrapFunctionInstance(raw any) engineext.FunctionInstance {
 	return raw.(engineext.FunctionInstance)
 }
+
+// MustUnwrapExportedFunction recovers the module instance and function index backing
+// a guest-facing api.Function, e.g. one returned by an ImportResolverFunc. It panics
+// if f doesn't implement engineext.ExportedFunction; it doesn't check whether the
+// module instance is one this engine knows (NewModuleEngine does that).
+func MustUnwrapExportedFunction(f api.Function) (moduleInstance any, index engineext.Index) {
+	exported := f.(engineext.ExportedFunction)
+	return exported.ModuleInstance(), exported.Index()
+}
+
+// mustUnwrapMemoryInstancePtr recovers the *wasm.MemoryInstance backing an
+// api.Memory returned from an ImportMemoryResolverFunc. wazero's api.Memory is
+// always implemented by a single concrete type wrapping *wasm.MemoryInstance, so
+// (like ConfigureCranelift) this reaches into the interface's data word directly
+// rather than requiring engineext to expose an unwrap method for it.
+// https://research.swtch.com/interfaces
+func mustUnwrapMemoryInstancePtr(mem api.Memory) uintptr {
+	type iface struct {
+		tp   *byte
+		data unsafe.Pointer
+	}
+	return uintptr((*iface)(unsafe.Pointer(&mem)).data)
+}
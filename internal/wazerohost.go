@@ -59,6 +59,9 @@ func (e *engine) addWazeroModule(ctx context.Context) {
 		WithFunc(e.exportIsLocallyDefinedFunction).
 		Export("is_locally_defined_function").
 		NewFunctionBuilder().
+		WithFunc(e.exportMemoryCount).
+		Export("memory_count").
+		NewFunctionBuilder().
 		WithFunc(e.exportMemoryMinMax).
 		Export("memory_min_max").
 		NewFunctionBuilder().
@@ -76,6 +79,9 @@ func (e *engine) addWazeroModule(ctx context.Context) {
 		NewFunctionBuilder().
 		WithFunc(e.exportVmContextImportedFunctionOffset).
 		Export("vm_context_imported_function_offset").
+		NewFunctionBuilder().
+		WithFunc(e.exportTableElementWrite).
+		Export("table_element_write").
 		Instantiate(ctx)
 	if err != nil {
 		panic(err)
@@ -84,6 +90,8 @@ func (e *engine) addWazeroModule(ctx context.Context) {
 
 func (e *engine) exportCompileDone(ctx context.Context, mod api.Module, codePtr, codeSize, relocsPtr, relocCounts uint32) {
 	m := mustModulePtrFromContext(ctx)
+	funcIndex := mustFuncIndexFromContext(ctx)
+	importedFns := mustImportedFunctionCountFromContext(ctx)
 
 	compiled, ok := mod.Memory().Read(codePtr, codeSize)
 	if !ok {
@@ -113,12 +121,19 @@ func (e *engine) exportCompileDone(ctx context.Context, mod api.Module, codePtr,
 		runtime.KeepAlive(relocInfos)
 	}
 
-	// TODO: take mutex lock.
 	id := m.ModuleID()
-	e.pendingCompiledFunctions[id] = append(e.pendingCompiledFunctions[id], pendingCompiledBody{
+	localIndex := funcIndex - importedFns
+
+	e.pendingMu.Lock()
+	defer e.pendingMu.Unlock()
+	bodies, ok := e.pendingCompiledFunctions[id]
+	if !ok || int(localIndex) >= len(bodies) {
+		panic("BUG: compile_done called for a function outside the current compilation batch")
+	}
+	bodies[localIndex] = pendingCompiledBody{
 		machineCode: body,
 		relocs:      relocs,
-	})
+	}
 }
 
 func (e *engine) exportFuncIndex(ctx context.Context, _ api.Module) uint32 {
@@ -171,9 +186,17 @@ func (e *engine) exportIsLocallyDefinedFunction(ctx context.Context, _ api.Modul
 	}
 }
 
-func (e *engine) exportMemoryMinMax(ctx context.Context, craneliftMod api.Module, minPtr, maxPtr uint32) uint32 {
+// exportMemoryCount reports the total number of memories (imported, then local) that
+// the module under compilation declares, so the Cranelift side can iterate them when
+// emitting multi-memory accesses.
+func (e *engine) exportMemoryCount(ctx context.Context, _ api.Module) uint32 {
 	m := mustModulePtrFromContext(ctx)
-	min, max, ok := m.MemoryMinMax()
+	return m.ImportedMemoriesCount() + m.LocalMemoriesCount()
+}
+
+func (e *engine) exportMemoryMinMax(ctx context.Context, craneliftMod api.Module, memIndex, minPtr, maxPtr uint32) uint32 {
+	m := mustModulePtrFromContext(ctx)
+	min, max, ok := m.MemoryMinMax(memIndex)
 	if !ok {
 		return 0
 	}
@@ -184,27 +207,50 @@ func (e *engine) exportMemoryMinMax(ctx context.Context, craneliftMod api.Module
 	return 1
 }
 
-func (e *engine) exportIsMemoryImported(ctx context.Context, _ api.Module) uint32 {
+func (e *engine) exportIsMemoryImported(ctx context.Context, _ api.Module, memIndex uint32) uint32 {
 	m := mustModulePtrFromContext(ctx)
-	if m.ImportedMemoriesCount() > 0 {
+	if memIndex < m.ImportedMemoriesCount() {
 		return 1
 	} else {
 		return 0
 	}
 }
 
-func (e *engine) exportVmContextLocalMemoryOffset(ctx context.Context, _ api.Module) uint32 {
+// exportVmContextLocalMemoryOffset, like exportMemoryMinMax and
+// exportIsMemoryImported, takes memIndex as a *global* memory index (imported
+// memories first, then local ones). localMemoryBegins is keyed per-class (0-based
+// within the local memories only), so the imported count is subtracted first.
+func (e *engine) exportVmContextLocalMemoryOffset(ctx context.Context, _ api.Module, memIndex uint32) uint32 {
+	m := mustModulePtrFromContext(ctx)
 	offsets := mustVmContextOffsetsFromContext(ctx)
-	return uint32(offsets.localMemoryBegin)
+	return uint32(offsets.localMemoryBegins[memIndex-m.ImportedMemoriesCount()])
 }
 
 func (e *engine) exportMemoryInstanceBaseOffset() uint32 {
 	return engineext.MemoryInstanceBufferOffset
 }
 
-func (e *engine) exportVmContextImportedMemoryOffset(ctx context.Context, _ api.Module) uint32 {
+// exportVmContextImportedMemoryOffset also takes a global memory index, but
+// imported memories are numbered first, so the per-class index equals the global
+// one and no adjustment is needed here (contrast exportVmContextLocalMemoryOffset).
+func (e *engine) exportVmContextImportedMemoryOffset(ctx context.Context, _ api.Module, memIndex uint32) uint32 {
 	offsets := mustVmContextOffsetsFromContext(ctx)
-	return uint32(offsets.importedMemoryBegin)
+	return uint32(offsets.importedMemoryBegins[memIndex])
+}
+
+// errTableSupportUnimplemented is the panic value exportTableElementWrite raises.
+// Like wasiExitError, wazero recovers a panicking host function and surfaces it as
+// the error returned from the compiling exported function's Call, so a guest that
+// hits this during compilation fails that one CompileModule call with a clear error
+// instead of taking down the host process.
+var errTableSupportUnimplemented = fmt.Errorf("cranelift: table support (table.set/table.init of a funcref/externref) is not implemented in this engine yet")
+
+// exportTableElementWrite implements the GC-safe write barrier Cranelift must use
+// whenever it stores a funcref/externref into a table element, per the reference-types
+// proposal. This engine doesn't yet model tables (see vmContext.LookupFunction /
+// GetFunctionReferences), so there is nothing to write into yet.
+func (e *engine) exportTableElementWrite(ctx context.Context, _ api.Module, tableIndex, elemIndex uint32, value uint64) {
+	panic(errTableSupportUnimplemented)
 }
 
 func (e *engine) exportVmContextImportedFunctionOffset(ctx context.Context, _ api.Module, index uint32) uint32 {
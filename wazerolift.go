@@ -10,6 +10,46 @@ import (
 	"github.com/tetratelabs/wazerolift/internal/wazero/engineext"
 )
 
+// WithCompilationCacheDir returns a context derived from ctx that, when later passed
+// to wazero.NewRuntimeWithConfig, opts the Cranelift engine into persisting compiled
+// machine code under dir across process restarts instead of re-invoking Cranelift for
+// every module. dir is created on first use if it does not already exist.
+func WithCompilationCacheDir(ctx context.Context, dir string) context.Context {
+	return cranelift.WithCompilationCacheDir(ctx, dir)
+}
+
+// WithCompileConcurrency returns a context derived from ctx that configures the
+// Cranelift engine created from it to compile up to n functions of a module
+// concurrently, each on its own Cranelift worker instance. It defaults to
+// runtime.GOMAXPROCS(0) when unset.
+func WithCompileConcurrency(ctx context.Context, n int) context.Context {
+	return cranelift.WithCompileConcurrency(ctx, n)
+}
+
+// WithImportResolver returns a context derived from ctx that, when passed to
+// wazero.Runtime's InstantiateModule, lets resolver override the call target of an
+// imported function at instantiation time, rather than the target statically linked
+// at compile time. Returning nil from resolver falls through to that default target.
+func WithImportResolver(ctx context.Context, resolver cranelift.ImportResolverFunc) context.Context {
+	return cranelift.WithImportResolver(ctx, resolver)
+}
+
+// WithImportMemoryResolver returns a context derived from ctx that, when passed to
+// wazero.Runtime's InstantiateModule, lets resolver override the call target of an
+// imported memory at instantiation time, mirroring WithImportResolver for functions.
+// Returning nil from resolver falls through to the statically-linked target.
+func WithImportMemoryResolver(ctx context.Context, resolver cranelift.ImportMemoryResolverFunc) context.Context {
+	return cranelift.WithImportMemoryResolver(ctx, resolver)
+}
+
+// ConfigureCranelift installs the Cranelift-backed engine into config, for use with
+// wazero.NewRuntimeWithConfig. The engine supports the WebAssembly MVP plus
+// multi-memory. It does not yet support: the reference-types proposal (a module
+// that executes table.set/table.init of a funcref or externref fails compilation
+// with a clear error rather than running unsafely; see errTableSupportUnimplemented
+// internally); Go-backed host modules that declare any functions (wazero.
+// NewHostModuleBuilder modules with only memories/globals are fine); or the typed
+// continuations proposal (rejected at engine creation if requested via CoreFeatures).
 func ConfigureCranelift(config wazero.RuntimeConfig) {
 	// This is the internal representation of interface in Go.
 	// https://research.swtch.com/interfaces